@@ -0,0 +1,269 @@
+package buildstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// IndexSchemaVersion is bumped whenever the on-disk layout of the index
+// written by IndexWriter changes incompatibly. OpenIndex refuses to open
+// (and ensureIndex, in the src package, regenerates) an index stamped with
+// a different version.
+const IndexSchemaVersion = 1
+
+// IndexDir returns the directory under the commit's build data where the
+// serving index (see IndexWriter/Index) is stored.
+func (s *RepositoryStore) IndexDir(commitID string) string {
+	return filepath.Join(s.CommitPath(commitID), "index")
+}
+
+// Key prefixes for the three tables multiplexed onto the single LevelDB
+// instance. Splitting into separate DBs would also work, but a single DB
+// means a single version stamp and a single fsync on Close.
+const (
+	fileUnitsPrefix = "fu\x00" // fileUnitsPrefix + file -> json([]UnitStub
+	unitRefsPrefix  = "ur\x00" // unitRefsPrefix + unit Name + "\x00" + unit Type + "\x00" + file -> json([]RefEntry), sorted by Start
+	defRefsPrefix   = "dr\x00" // defRefsPrefix + defKey -> json([]RefLocation)
+	versionKey      = "version"
+)
+
+// UnitStub carries just enough of a unit.SourceUnit's identity (Name and
+// Type, the two fields that make up its ID) to satisfy callers that only
+// need to locate the unit's graph output, without duplicating the unit's
+// full (possibly large) Files list in the index.
+type UnitStub struct {
+	Name string
+	Type string
+}
+
+// RefEntry is the indexed form of a graph.Ref: its byte range plus the
+// index of the full ref within that unit's graph.json Refs slice, so
+// readers can binary-search by Start without deserializing every ref in
+// the file.
+type RefEntry struct {
+	Start, End int
+	RefIdx     int
+}
+
+// DefKey identifies a definition the same way graph.Ref identifies the def
+// it points to, so the reverse index can be looked up directly from a Ref.
+type DefKey struct {
+	DefRepo     string
+	DefUnit     string
+	DefUnitType string
+	DefPath     string
+}
+
+func (k DefKey) String() string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s", k.DefRepo, k.DefUnit, k.DefUnitType, k.DefPath)
+}
+
+// RefLocation identifies a single graph.Ref by the unit that contains it
+// and its index within that unit's graph.json Refs slice.
+type RefLocation struct {
+	Unit   UnitStub
+	RefIdx int
+}
+
+// IndexWriter builds the file→units, (unit+file)→refs, and def→refs tables
+// for a single commit. Callers add every unit's data with AddUnit/AddRefs,
+// then call Close to stamp the schema version and flush to disk.
+type IndexWriter struct {
+	db *leveldb.DB
+}
+
+// NewIndexWriter creates (overwriting any existing) index for commitID.
+func NewIndexWriter(store *RepositoryStore, commitID string) (*IndexWriter, error) {
+	if err := DeleteIndex(store, commitID); err != nil {
+		return nil, err
+	}
+	db, err := leveldb.OpenFile(store.IndexDir(commitID), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexWriter{db: db}, nil
+}
+
+// AddUnit records that file belongs to u, appending to any units already
+// recorded for that file.
+func (w *IndexWriter) AddUnit(file string, u UnitStub) error {
+	key := []byte(fileUnitsPrefix + file)
+	var stubs []UnitStub
+	if data, err := w.db.Get(key, nil); err == nil {
+		if err := json.Unmarshal(data, &stubs); err != nil {
+			return err
+		}
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	stubs = append(stubs, u)
+	data, err := json.Marshal(stubs)
+	if err != nil {
+		return err
+	}
+	return w.db.Put(key, data, nil)
+}
+
+// AddRefs writes the (already file-filtered) refs for u/file in one batch,
+// sorting them by Start so readers can binary search.
+func (w *IndexWriter) AddRefs(u UnitStub, file string, refs []RefEntry) error {
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Start < refs[j].Start })
+	data, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+	return w.db.Put(unitRefsKey(u, file), data, nil)
+}
+
+// AddDefRef appends (u, refIdx) to the reverse index for key, which the
+// find-all-references command (APIRefsCmd) reads.
+func (w *IndexWriter) AddDefRef(key DefKey, loc RefLocation) error {
+	dbKey := []byte(defRefsPrefix + key.String())
+	var locs []RefLocation
+	if data, err := w.db.Get(dbKey, nil); err == nil {
+		if err := json.Unmarshal(data, &locs); err != nil {
+			return err
+		}
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	locs = append(locs, loc)
+	data, err := json.Marshal(locs)
+	if err != nil {
+		return err
+	}
+	return w.db.Put(dbKey, data, nil)
+}
+
+// Close stamps the index with IndexSchemaVersion and closes the underlying
+// LevelDB handle. The index is not considered valid by OpenIndex until
+// Close has succeeded.
+func (w *IndexWriter) Close() error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], IndexSchemaVersion)
+	if err := w.db.Put([]byte(versionKey), buf[:], nil); err != nil {
+		w.db.Close()
+		return err
+	}
+	return w.db.Close()
+}
+
+// Index is a read-only handle on a commit's serving index, opened with
+// OpenIndex. Callers should fall back to a full build-store walk when
+// OpenIndex returns an error (no index present, or a schema mismatch).
+type Index struct {
+	db *leveldb.DB
+}
+
+// OpenIndex opens the index for commitID, returning an error if it doesn't
+// exist or was written by a different IndexSchemaVersion.
+func OpenIndex(store *RepositoryStore, commitID string) (*Index, error) {
+	dir := store.IndexDir(commitID)
+	db, err := leveldb.OpenFile(dir, &leveldb.Options{ErrorIfMissing: true})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := db.Get([]byte(versionKey), nil)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("index at %s has no version stamp (incomplete build?): %s", dir, err)
+	}
+	if binary.BigEndian.Uint64(data) != IndexSchemaVersion {
+		db.Close()
+		return nil, fmt.Errorf("index at %s was built with a different schema version, rebuild needed", dir)
+	}
+
+	return &Index{db: db}, nil
+}
+
+// Close releases the underlying LevelDB handle.
+func (idx *Index) Close() error { return idx.db.Close() }
+
+// FileUnits returns the units (by Name/Type stub) that contain file, or
+// (nil, nil) if no unit in the index claims it.
+func (idx *Index) FileUnits(file string) ([]UnitStub, error) {
+	data, err := idx.db.Get([]byte(fileUnitsPrefix+file), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var stubs []UnitStub
+	if err := json.Unmarshal(data, &stubs); err != nil {
+		return nil, err
+	}
+	return stubs, nil
+}
+
+// FileRefs returns the refs in file belonging to u, sorted by Start.
+func (idx *Index) FileRefs(u UnitStub, file string) ([]RefEntry, error) {
+	data, err := idx.db.Get(unitRefsKey(u, file), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []RefEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// RefAtByte returns the RefEntry in entries (as returned by FileRefs, which
+// are sorted by Start) containing startByte, using binary search, or false
+// if none contains it.
+func RefAtByte(entries []RefEntry, startByte int) (RefEntry, bool) {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Start > startByte })
+	// entries[i-1] is the last entry with Start <= startByte; since refs in
+	// a file don't overlap in practice, it's the only candidate.
+	if i == 0 {
+		return RefEntry{}, false
+	}
+	e := entries[i-1]
+	if startByte <= e.End {
+		return e, true
+	}
+	return RefEntry{}, false
+}
+
+// DefRefs returns every (unit, refIdx) location recorded against key.
+func (idx *Index) DefRefs(key DefKey) ([]RefLocation, error) {
+	data, err := idx.db.Get([]byte(defRefsPrefix+key.String()), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var locs []RefLocation
+	if err := json.Unmarshal(data, &locs); err != nil {
+		return nil, err
+	}
+	return locs, nil
+}
+
+func unitRefsKey(u UnitStub, file string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(unitRefsPrefix)
+	buf.WriteString(u.Name)
+	buf.WriteByte(0)
+	buf.WriteString(u.Type)
+	buf.WriteByte(0)
+	buf.WriteString(file)
+	return buf.Bytes()
+}
+
+// DeleteIndex removes the on-disk index for commitID, forcing the next
+// OpenIndex to fail and callers to fall back (or rebuild via
+// --rebuild-index).
+func DeleteIndex(store *RepositoryStore, commitID string) error {
+	return os.RemoveAll(store.IndexDir(commitID))
+}
@@ -0,0 +1,93 @@
+package plan
+
+import "sourcegraph.com/sourcegraph/srclib/unit"
+
+// unitKey identifies a source unit the same way unit.SourceUnit.ID() does,
+// without requiring callers to go through the (string-formatted) ID.
+type unitKey struct{ name, typ string }
+
+func keyOf(u *unit.SourceUnit) unitKey { return unitKey{u.Name, u.Type} }
+
+// FilterUnits returns the subset of units whose Files intersect
+// changedFiles, plus every unit that transitively depends (directly or
+// indirectly, via Dependencies) on one of those units — so that editing a
+// leaf package also causes whatever imports it to be re-graphed, not just
+// the package that changed. A nil changedFiles returns units unchanged,
+// which is what a full (non-incremental) build wants. This is what
+// MakeCmd.Execute calls to honor MakeCmd.OnlyFiles (see ensureBuild in
+// src/api_cmds.go, which sets it from a git diff).
+func FilterUnits(units []*unit.SourceUnit, changedFiles []string) []*unit.SourceUnit {
+	if changedFiles == nil {
+		return units
+	}
+
+	changed := make(map[string]bool, len(changedFiles))
+	for _, f := range changedFiles {
+		changed[f] = true
+	}
+
+	byName := make(map[string]unitKey, len(units))
+	for _, u := range units {
+		byName[u.Name] = keyOf(u)
+	}
+
+	// dependents[X] = units that declare a dependency on X, so marking X
+	// as needing a rebuild also marks them.
+	dependents := make(map[unitKey][]unitKey)
+	for _, u := range units {
+		for _, dep := range u.Dependencies {
+			if depKey, ok := resolveDependency(byName, dep); ok {
+				dependents[depKey] = append(dependents[depKey], keyOf(u))
+			}
+		}
+	}
+
+	included := make(map[unitKey]bool)
+	var queue []unitKey
+	for _, u := range units {
+		for _, f := range u.Files {
+			if changed[f] {
+				mark(keyOf(u), included, &queue)
+				break
+			}
+		}
+	}
+	for len(queue) > 0 {
+		k := queue[0]
+		queue = queue[1:]
+		for _, dk := range dependents[k] {
+			mark(dk, included, &queue)
+		}
+	}
+
+	var result []*unit.SourceUnit
+	for _, u := range units {
+		if included[keyOf(u)] {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+func mark(k unitKey, included map[unitKey]bool, queue *[]unitKey) {
+	if !included[k] {
+		included[k] = true
+		*queue = append(*queue, k)
+	}
+}
+
+// resolveDependency best-effort matches one of a unit's Dependencies
+// entries against the known units by name. A SourceUnit's Dependencies are
+// toolchain-specific (usually the dependency's unit name or import path as
+// a string); anything else is left unresolved rather than erroring, since
+// an unresolvable dependency just means that edge is missed for the
+// purposes of this incremental-rebuild optimization, not a correctness
+// failure (the change itself is never dropped, only its ripple effect).
+func resolveDependency(byName map[string]unitKey, dep interface{}) (unitKey, bool) {
+	name, ok := dep.(string)
+	if !ok {
+		return unitKey{}, false
+	}
+	k, ok := byName[name]
+	return k, ok
+}
@@ -46,6 +46,24 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	_, err = c.AddCommand("refs",
+		"list all refs to a def",
+		"Find every reference (in this repo, and, for external defs, on Sourcegraph.com) to the def under the cursor or identified by --def-*, grouped by file and sorted by byte offset.",
+		&apiRefsCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("serve",
+		"run a persistent API server (with an LSP bridge)",
+		"Runs a long-lived JSON-RPC 1.0 server (Go's net/rpc/jsonrpc codec; JSON-RPC 2.0 framing is not supported) over stdio and/or TCP that keeps a warm build store and in-memory caches, so editors get low-latency describe/list/references/hover/definition/documentSymbol responses without re-running the build on every request.",
+		&apiServeCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 type APICmd struct{}
@@ -59,14 +77,23 @@ type APIDescribeCmd struct {
 	StartByte int    `long:"start-byte" required:"yes" value-name:"BYTE"`
 
 	NoExamples bool `long:"no-examples" describe:"don't show examples from Sourcegraph.com"`
+
+	RebuildIndex bool `long:"rebuild-index" description:"force regeneration of the persistent file/ref index before looking up this position"`
+
+	APIParallelism int `long:"api-parallelism" description:"number of unit/graph files to decode concurrently (default: number of CPUs)" value-name:"N"`
 }
 
 type APIListCmd struct {
 	File string `long:"file" required:"yes" value-name:"FILE"`
+
+	RebuildIndex bool `long:"rebuild-index" description:"force regeneration of the persistent file/ref index before listing this file's refs"`
+
+	APIParallelism int `long:"api-parallelism" description:"number of unit/graph files to decode concurrently (default: number of CPUs)" value-name:"N"`
 }
 
 var apiDescribeCmd APIDescribeCmd
 var apiListCmd APIListCmd
+var apiServeCmd APIServeCmd
 
 // Invokes the build process on the given repository
 func ensureBuild(buildStore *buildstore.RepositoryStore, repo *Repo) error {
@@ -88,24 +115,52 @@ func ensureBuild(buildStore *buildstore.RepositoryStore, repo *Repo) error {
 		}
 	}
 
-	// Always re-make.
-	//
-	// TODO(sqs): optimize this
+	// Re-make, restricted to the files that changed since the last build
+	// when that can be determined safely; otherwise fall back to a full
+	// rebuild.
+	changedFiles, lastCommit, fullRebuildReason := incrementalRebuildPlan(buildStore, repo)
+	if fullRebuildReason != "" {
+		if GlobalOpt.Verbose {
+			log.Printf("ensureBuild: full rebuild (%s).", fullRebuildReason)
+		}
+	} else if GlobalOpt.Verbose {
+		log.Printf("ensureBuild: incremental rebuild vs %s (%d changed files).", lastCommit, len(changedFiles))
+	}
+
 	makeCmd := &MakeCmd{
 		Options:          configOpt,
 		ToolchainExecOpt: toolchainExecOpt,
+		OnlyFiles:        changedFiles,
 	}
 	if err := makeCmd.Execute(nil); err != nil {
 		return err
 	}
 
+	if fullRebuildReason == "" {
+		// Units whose files didn't change were never re-graphed by the
+		// filtered MakeCmd run above; carry their existing outputs forward
+		// so this commit's build directory is still complete.
+		if err := seedUnchangedUnits(buildStore, repo, lastCommit); err != nil && GlobalOpt.Verbose {
+			log.Printf("ensureBuild: couldn't seed unchanged units from %s: %s", lastCommit, err)
+		}
+	}
+
+	if tcVersion, err := currentToolchainVersion(); err != nil {
+		if GlobalOpt.Verbose {
+			log.Printf("ensureBuild: couldn't fingerprint installed toolchains, not persisting build manifest: %s", err)
+		}
+	} else {
+		meta := &buildMeta{CommitID: repo.CommitID, ToolchainVersion: tcVersion}
+		if err := writeBuildMeta(buildStore, repo.CommitID, meta); err != nil && GlobalOpt.Verbose {
+			log.Printf("ensureBuild: couldn't persist build manifest: %s", err)
+		}
+	}
+
 	return nil
 }
 
-// Get a list of all source units that contain the given file
-func getSourceUnitsWithFile(buildStore *buildstore.RepositoryStore, repo *Repo, filename string) ([]*unit.SourceUnit, error) {
-	filename = filepath.Clean(filename)
-
+// getAllSourceUnits decodes every *.unit.json file in the build store.
+func getAllSourceUnits(buildStore *buildstore.RepositoryStore, repo *Repo) ([]*unit.SourceUnit, error) {
 	// TODO(sqs): This whole lookup is totally inefficient. The storage format
 	// is not optimized for lookups.
 
@@ -119,18 +174,21 @@ func getSourceUnitsWithFile(buildStore *buildstore.RepositoryStore, repo *Repo,
 		}
 	}
 
-	// Find which source units the file belongs to.
+	return decodeUnitFiles(buildStore, unitFiles)
+}
+
+// getSourceUnitsWithFile returns the source units (among all units in the
+// build store) whose Files list contains filename.
+func getSourceUnitsWithFile(buildStore *buildstore.RepositoryStore, repo *Repo, filename string) ([]*unit.SourceUnit, error) {
+	filename = filepath.Clean(filename)
+
+	allUnits, err := getAllSourceUnits(buildStore, repo)
+	if err != nil {
+		return nil, err
+	}
+
 	var units []*unit.SourceUnit
-	for _, unitFile := range unitFiles {
-		var u *unit.SourceUnit
-		f, err := buildStore.Open(unitFile)
-		if err != nil {
-			return nil, err
-		}
-		defer f.Close()
-		if err := json.NewDecoder(f).Decode(&u); err != nil {
-			return nil, fmt.Errorf("%s: %s", unitFile, err)
-		}
+	for _, u := range allUnits {
 		for _, f2 := range u.Files {
 			if filepath.Clean(f2) == filename {
 				units = append(units, u)
@@ -142,7 +200,90 @@ func getSourceUnitsWithFile(buildStore *buildstore.RepositoryStore, repo *Repo,
 	return units, nil
 }
 
+// findRefAtPosition scans the graph output of each of units for a ref in
+// file that contains startByte, returning the first match. It is the
+// fallback lookupRefAtPosition uses when no index is available;
+// apiServer.findRef does the same scan against its warm cache instead of a
+// fresh decode.
+func findRefAtPosition(buildStore *buildstore.RepositoryStore, repo *Repo, units []*unit.SourceUnit, file string, startByte int) (*graph.Ref, error) {
+	for _, u := range units {
+		g, err := decodeGraphOutput(buildStore, repo, u)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range g.Refs {
+			if file == ref.File && startByte >= ref.Start && startByte <= ref.End {
+				if ref.DefUnit == "" {
+					ref.DefUnit = u.Name
+				}
+				if ref.DefUnitType == "" {
+					ref.DefUnitType = u.Type
+				}
+				return ref, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// findDefInRepo resolves ref to its *sourcegraph.Def when the def lives in
+// the current repo, returning (nil, nil) when it doesn't (in which case the
+// caller should fall back to the Sourcegraph API, as APIDescribeCmd does).
+func findDefInRepo(buildStore *buildstore.RepositoryStore, repo *Repo, ref *graph.Ref) (*sourcegraph.Def, error) {
+	if ref.DefRepo == "" {
+		ref.DefRepo = repo.URI()
+	}
+	if ref.DefRepo != repo.URI() {
+		return nil, nil
+	}
+
+	g, err := decodeGraphOutput(buildStore, repo, &unit.SourceUnit{Name: ref.DefUnit, Type: ref.DefUnitType})
+	if err != nil {
+		return nil, err
+	}
+
+	var def *sourcegraph.Def
+	for _, def2 := range g.Defs {
+		if def2.Path == ref.DefPath {
+			def = &sourcegraph.Def{Def: *def2}
+			break
+		}
+	}
+	if def != nil {
+		for _, doc := range g.Docs {
+			if doc.Path == ref.DefPath {
+				def.DocHTML = doc.Data
+			}
+		}
+
+		// If Def is in the current Repo, transform that path to be an absolute path
+		def.File = filepath.Join(repo.RootDir, def.File)
+	} else if GlobalOpt.Verbose {
+		log.Printf("No definition found with path %q in unit %q type %q.", ref.DefPath, ref.DefUnit, ref.DefUnitType)
+	}
+	return def, nil
+}
+
+// decodeGraphOutput opens and decodes the graph.json for u. Callers that
+// need to do this for many units (APIListCmd, APIDescribeCmd) or
+// repeatedly (APIServeCmd) should prefer going through a cache instead of
+// calling this directly.
+func decodeGraphOutput(buildStore *buildstore.RepositoryStore, repo *Repo, u *unit.SourceUnit) (*grapher.Output, error) {
+	var g grapher.Output
+	graphFile := buildStore.FilePath(repo.CommitID, plan.SourceUnitDataFilename("graph", u))
+	f, err := buildStore.Open(graphFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&g); err != nil {
+		return nil, fmt.Errorf("%s: %s", graphFile, err)
+	}
+	return &g, nil
+}
+
 func (c *APIListCmd) Execute(args []string) error {
+	setAPIParallelism(c.APIParallelism)
 	c.File = filepath.Clean(c.File)
 
 	repo, err := OpenRepo(filepath.Dir(c.File))
@@ -167,8 +308,9 @@ func (c *APIListCmd) Execute(args []string) error {
 	if err := ensureBuild(buildStore, repo); err != nil {
 		return err
 	}
+	ensureIndex(buildStore, repo, c.RebuildIndex)
 
-	units, err := getSourceUnitsWithFile(buildStore, repo, c.File)
+	units, err := lookupUnitsWithFile(buildStore, repo, c.File)
 	if err != nil {
 		return err
 	}
@@ -186,18 +328,12 @@ func (c *APIListCmd) Execute(args []string) error {
 	}
 
 	// Find the ref(s) at the character position.
+	graphs, err := decodeGraphOutputs(buildStore, repo, units)
+	if err != nil {
+		return err
+	}
 	var refs []*graph.Ref
-	for _, u := range units {
-		var g grapher.Output
-		graphFile := buildStore.FilePath(repo.CommitID, plan.SourceUnitDataFilename("graph", u))
-		f, err := buildStore.Open(graphFile)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		if err := json.NewDecoder(f).Decode(&g); err != nil {
-			return fmt.Errorf("%s: %s", graphFile, err)
-		}
+	for _, g := range graphs {
 		for _, ref := range g.Refs {
 			if c.File == ref.File {
 				refs = append(refs, ref)
@@ -212,6 +348,7 @@ func (c *APIListCmd) Execute(args []string) error {
 }
 
 func (c *APIDescribeCmd) Execute(args []string) error {
+	setAPIParallelism(c.APIParallelism)
 	c.File = filepath.Clean(c.File)
 
 	repo, err := OpenRepo(filepath.Dir(c.File))
@@ -236,8 +373,9 @@ func (c *APIDescribeCmd) Execute(args []string) error {
 	if err := ensureBuild(buildStore, repo); err != nil {
 		return err
 	}
+	ensureIndex(buildStore, repo, c.RebuildIndex)
 
-	units, err := getSourceUnitsWithFile(buildStore, repo, c.File)
+	units, err := lookupUnitsWithFile(buildStore, repo, c.File)
 	if err != nil {
 		return err
 	}
@@ -255,31 +393,9 @@ func (c *APIDescribeCmd) Execute(args []string) error {
 	}
 
 	// Find the ref(s) at the character position.
-	var ref *graph.Ref
-OuterLoop:
-	for _, u := range units {
-		var g grapher.Output
-		graphFile := buildStore.FilePath(repo.CommitID, plan.SourceUnitDataFilename("graph", u))
-		f, err := buildStore.Open(graphFile)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		if err := json.NewDecoder(f).Decode(&g); err != nil {
-			return fmt.Errorf("%s: %s", graphFile, err)
-		}
-		for _, ref2 := range g.Refs {
-			if c.File == ref2.File && c.StartByte >= ref2.Start && c.StartByte <= ref2.End {
-				ref = ref2
-				if ref.DefUnit == "" {
-					ref.DefUnit = u.Name
-				}
-				if ref.DefUnitType == "" {
-					ref.DefUnitType = u.Type
-				}
-				break OuterLoop
-			}
-		}
+	ref, err := lookupRefAtPosition(buildStore, repo, units, c.File, c.StartByte)
+	if err != nil {
+		return err
 	}
 
 	if ref == nil {
@@ -290,48 +406,15 @@ OuterLoop:
 		return nil
 	}
 
-	if ref.DefRepo == "" {
-		ref.DefRepo = repo.URI()
-	}
-
 	var resp struct {
 		Def      *sourcegraph.Def
 		Examples []*sourcegraph.Example
 	}
 
 	// Now find the def for this ref.
-	defInCurrentRepo := ref.DefRepo == repo.URI()
-	if defInCurrentRepo {
-		// Def is in the current repo.
-		var g grapher.Output
-		graphFile := buildStore.FilePath(repo.CommitID, plan.SourceUnitDataFilename("graph", &unit.SourceUnit{Name: ref.DefUnit, Type: ref.DefUnitType}))
-		f, err := buildStore.Open(graphFile)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		if err := json.NewDecoder(f).Decode(&g); err != nil {
-			return fmt.Errorf("%s: %s", graphFile, err)
-		}
-		for _, def2 := range g.Defs {
-			if def2.Path == ref.DefPath {
-				resp.Def = &sourcegraph.Def{Def: *def2}
-				break
-			}
-		}
-		if resp.Def != nil {
-			for _, doc := range g.Docs {
-				if doc.Path == ref.DefPath {
-					resp.Def.DocHTML = doc.Data
-				}
-			}
-
-			// If Def is in the current Repo, transform that path to be an absolute path
-			resp.Def.File = filepath.Join(repo.RootDir, resp.Def.File)
-		}
-		if resp.Def == nil && GlobalOpt.Verbose {
-			log.Printf("No definition found with path %q in unit %q type %q.", ref.DefPath, ref.DefUnit, ref.DefUnitType)
-		}
+	resp.Def, err = findDefInRepo(buildStore, repo, ref)
+	if err != nil {
+		return err
 	}
 
 	spec := sourcegraph.DefSpec{
@@ -0,0 +1,181 @@
+package src
+
+import (
+	"log"
+
+	"sourcegraph.com/sourcegraph/srclib/buildstore"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/grapher"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// ensureIndex makes sure a valid buildstore.Index exists for repo's current
+// commit, (re)building it from the already-built *.unit.json/graph.json
+// files when it's missing, stale (wrong schema version), or rebuild is
+// forced. It never errors out of the caller's command: indexing is an
+// optimization, so any failure just means API commands fall back to the
+// O(files×units) walk they've always done.
+func ensureIndex(buildStore *buildstore.RepositoryStore, repo *Repo, rebuild bool) {
+	if !rebuild {
+		if idx, err := buildstore.OpenIndex(buildStore, repo.CommitID); err == nil {
+			idx.Close()
+			return
+		}
+	}
+
+	if err := buildstore.DeleteIndex(buildStore, repo.CommitID); err != nil && GlobalOpt.Verbose {
+		log.Printf("api: couldn't remove stale index: %s", err)
+	}
+
+	if err := buildIndex(buildStore, repo); err != nil {
+		if GlobalOpt.Verbose {
+			log.Printf("api: couldn't build index, falling back to unindexed lookups: %s", err)
+		}
+		buildstore.DeleteIndex(buildStore, repo.CommitID)
+	}
+}
+
+// buildIndex is the build phase that populates the persistent file→unit,
+// (unit+file)→ref, and def→ref tables described in the indexing proposal.
+// It walks every unit exactly once, decoding its graph.json exactly once.
+func buildIndex(buildStore *buildstore.RepositoryStore, repo *Repo) error {
+	units, err := getAllSourceUnits(buildStore, repo)
+	if err != nil {
+		return err
+	}
+
+	w, err := buildstore.NewIndexWriter(buildStore, repo.CommitID)
+	if err != nil {
+		return err
+	}
+
+	if err := indexUnits(w, buildStore, repo, units); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func indexUnits(w *buildstore.IndexWriter, buildStore *buildstore.RepositoryStore, repo *Repo, units []*unit.SourceUnit) error {
+	// Decoding every unit's graph.json is the expensive part; fan it out,
+	// then write the (cheap, sequential) index entries from the results.
+	graphs, err := decodeGraphOutputs(buildStore, repo, units)
+	if err != nil {
+		return err
+	}
+
+	for i, u := range units {
+		stub := buildstore.UnitStub{Name: u.Name, Type: u.Type}
+		for _, f := range u.Files {
+			if err := w.AddUnit(f, stub); err != nil {
+				return err
+			}
+		}
+		if err := indexUnitRefs(w, stub, graphs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexUnitRefs(w *buildstore.IndexWriter, stub buildstore.UnitStub, g *grapher.Output) error {
+	byFile := make(map[string][]buildstore.RefEntry)
+	for i, ref := range g.Refs {
+		byFile[ref.File] = append(byFile[ref.File], buildstore.RefEntry{Start: ref.Start, End: ref.End, RefIdx: i})
+
+		defUnit, defUnitType := ref.DefUnit, ref.DefUnitType
+		if defUnit == "" {
+			defUnit = stub.Name
+		}
+		if defUnitType == "" {
+			defUnitType = stub.Type
+		}
+		key := buildstore.DefKey{DefRepo: ref.DefRepo, DefUnit: defUnit, DefUnitType: defUnitType, DefPath: ref.DefPath}
+		if err := w.AddDefRef(key, buildstore.RefLocation{Unit: stub, RefIdx: i}); err != nil {
+			return err
+		}
+	}
+	for file, refs := range byFile {
+		if err := w.AddRefs(stub, file, refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupUnitsWithFile resolves the source units containing file via the
+// persistent index when one is available and valid, falling back to the
+// full build-store walk (getSourceUnitsWithFile) otherwise.
+func lookupUnitsWithFile(buildStore *buildstore.RepositoryStore, repo *Repo, file string) ([]*unit.SourceUnit, error) {
+	idx, err := buildstore.OpenIndex(buildStore, repo.CommitID)
+	if err != nil {
+		return getSourceUnitsWithFile(buildStore, repo, file)
+	}
+	defer idx.Close()
+	return sourceUnitsWithFileIndexed(idx, file)
+}
+
+// lookupRefAtPosition resolves the ref at file:startByte via the persistent
+// index when available, falling back to findRefAtPosition (which requires
+// units to already have been resolved, e.g. via lookupUnitsWithFile)
+// otherwise.
+func lookupRefAtPosition(buildStore *buildstore.RepositoryStore, repo *Repo, units []*unit.SourceUnit, file string, startByte int) (*graph.Ref, error) {
+	idx, err := buildstore.OpenIndex(buildStore, repo.CommitID)
+	if err != nil {
+		return findRefAtPosition(buildStore, repo, units, file, startByte)
+	}
+	defer idx.Close()
+	return findRefAtPositionIndexed(buildStore, repo, idx, file, startByte)
+}
+
+// sourceUnitsWithFileIndexed is the index-backed equivalent of
+// getSourceUnitsWithFile: an O(1) map lookup instead of a walk over every
+// *.unit.json in the build store. A nil/empty result with a nil error
+// means idx simply has no entry for file, which callers should treat the
+// same as "no units", not as a reason to fall back to the build-store walk.
+func sourceUnitsWithFileIndexed(idx *buildstore.Index, file string) ([]*unit.SourceUnit, error) {
+	stubs, err := idx.FileUnits(file)
+	if err != nil {
+		return nil, err
+	}
+	units := make([]*unit.SourceUnit, len(stubs))
+	for i, stub := range stubs {
+		units[i] = &unit.SourceUnit{Name: stub.Name, Type: stub.Type}
+	}
+	return units, nil
+}
+
+// findRefAtPositionIndexed is the index-backed equivalent of
+// findRefAtPosition, using a binary search over each candidate unit's
+// sorted ref table instead of a linear scan of its full graph.Refs.
+func findRefAtPositionIndexed(buildStore *buildstore.RepositoryStore, repo *Repo, idx *buildstore.Index, file string, startByte int) (*graph.Ref, error) {
+	stubs, err := idx.FileUnits(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, stub := range stubs {
+		entries, err := idx.FileRefs(stub, file)
+		if err != nil {
+			return nil, err
+		}
+		entry, ok := buildstore.RefAtByte(entries, startByte)
+		if !ok {
+			continue
+		}
+
+		g, err := decodeGraphOutput(buildStore, repo, &unit.SourceUnit{Name: stub.Name, Type: stub.Type})
+		if err != nil {
+			return nil, err
+		}
+		ref := g.Refs[entry.RefIdx]
+		if ref.DefUnit == "" {
+			ref.DefUnit = stub.Name
+		}
+		if ref.DefUnitType == "" {
+			ref.DefUnitType = stub.Type
+		}
+		return ref, nil
+	}
+	return nil, nil
+}
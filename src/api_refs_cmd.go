@@ -0,0 +1,298 @@
+package src
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/go-sourcegraph/sourcegraph"
+	"sourcegraph.com/sourcegraph/srclib/buildstore"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+type APIRefsCmd struct {
+	File      string `long:"file" description:"resolve the def under the cursor in this file, like 'api describe'" value-name:"FILE"`
+	StartByte int    `long:"start-byte" description:"byte offset of the cursor in --file" value-name:"BYTE"`
+
+	DefRepo     string `long:"def-repo" description:"look up refs to this def directly, instead of resolving one under a cursor" value-name:"REPO"`
+	DefUnit     string `long:"def-unit" value-name:"UNIT"`
+	DefUnitType string `long:"def-unit-type" value-name:"UNITTYPE"`
+	DefPath     string `long:"def-path" value-name:"PATH"`
+
+	Format string `long:"format" description:"output format: json (one array) or jsonlines (one object per line, streamable)" default:"json" value-name:"json|jsonlines"`
+
+	RebuildIndex   bool `long:"rebuild-index" description:"force regeneration of the persistent file/ref index before looking up references"`
+	APIParallelism int  `long:"api-parallelism" description:"number of unit/graph files to decode concurrently (default: number of CPUs)" value-name:"N"`
+}
+
+var apiRefsCmd APIRefsCmd
+
+// apiRefsFileGroup is one file's worth of refs to a single def, sorted by
+// byte offset, as emitted by `api refs`.
+type apiRefsFileGroup struct {
+	File string       `json:"File"`
+	Refs []*graph.Ref `json:"Refs"`
+}
+
+func (c *APIRefsCmd) Execute(args []string) error {
+	setAPIParallelism(c.APIParallelism)
+
+	if c.Format != "json" && c.Format != "jsonlines" {
+		return fmt.Errorf("invalid --format %q (must be json or jsonlines)", c.Format)
+	}
+
+	var repoDir string
+	if c.File != "" {
+		repoDir = filepath.Dir(c.File)
+	} else {
+		repoDir = "."
+	}
+	repo, err := OpenRepo(repoDir)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chdir(repo.RootDir); err != nil {
+		return err
+	}
+
+	buildStore, err := buildstore.NewRepositoryStore(repo.RootDir)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureBuild(buildStore, repo); err != nil {
+		return err
+	}
+	ensureIndex(buildStore, repo, c.RebuildIndex)
+
+	spec, err := c.resolveDefSpec(buildStore, repo)
+	if err != nil {
+		return err
+	}
+
+	groups, err := refsToDef(buildStore, repo, spec)
+	if err != nil {
+		return err
+	}
+
+	if spec.Repo != string(repo.URI()) {
+		// The def is external: supplement in-repo refs (there likely are
+		// none) with cross-repo callers known to Sourcegraph.com, mirroring
+		// the ListExamples call APIDescribeCmd makes.
+		externalRefs, _, err := apiclient.Defs.ListRefs(spec, &sourcegraph.DefListRefsOptions{
+			ListOptions: sourcegraph.ListOptions{PerPage: 100},
+		})
+		if err != nil {
+			if GlobalOpt.Verbose {
+				log.Printf("Couldn't fetch external refs for %v: %s.", spec, err)
+			}
+		} else {
+			groups = mergeExternalRefs(groups, externalRefs)
+		}
+	}
+
+	return c.writeOutput(groups)
+}
+
+// resolveDefSpec determines the def being asked about, either from an
+// explicit --def-* quadruple or by resolving the ref under --file's cursor
+// position (the same lookup `api describe` does).
+func (c *APIRefsCmd) resolveDefSpec(buildStore *buildstore.RepositoryStore, repo *Repo) (sourcegraph.DefSpec, error) {
+	if c.DefPath != "" || c.DefUnit != "" {
+		defRepo := c.DefRepo
+		if defRepo == "" {
+			defRepo = string(repo.URI())
+		}
+		return sourcegraph.DefSpec{
+			Repo:     defRepo,
+			Unit:     c.DefUnit,
+			UnitType: c.DefUnitType,
+			Path:     c.DefPath,
+		}, nil
+	}
+
+	if c.File == "" {
+		return sourcegraph.DefSpec{}, fmt.Errorf("either --file/--start-byte or --def-path must be given")
+	}
+
+	file, err := filepath.Rel(repo.RootDir, filepath.Clean(c.File))
+	if err != nil {
+		return sourcegraph.DefSpec{}, err
+	}
+
+	units, err := lookupUnitsWithFile(buildStore, repo, file)
+	if err != nil {
+		return sourcegraph.DefSpec{}, err
+	}
+	ref, err := lookupRefAtPosition(buildStore, repo, units, file, c.StartByte)
+	if err != nil {
+		return sourcegraph.DefSpec{}, err
+	}
+	if ref == nil {
+		return sourcegraph.DefSpec{}, fmt.Errorf("no ref found at %s:%d", file, c.StartByte)
+	}
+	if ref.DefRepo == "" {
+		ref.DefRepo = repo.URI()
+	}
+	return sourcegraph.DefSpec{
+		Repo:     string(ref.DefRepo),
+		Unit:     ref.DefUnit,
+		UnitType: ref.DefUnitType,
+		Path:     string(ref.DefPath),
+	}, nil
+}
+
+// refsToDef finds every ref in the build store that resolves to spec,
+// grouped by file and sorted by byte offset within each file. It reads
+// from the persistent reverse index when one is available and falls back
+// to scanning every unit's graph output otherwise.
+func refsToDef(buildStore *buildstore.RepositoryStore, repo *Repo, spec sourcegraph.DefSpec) ([]apiRefsFileGroup, error) {
+	key := buildstore.DefKey{DefRepo: spec.Repo, DefUnit: spec.Unit, DefUnitType: spec.UnitType, DefPath: spec.Path}
+
+	var refs []*graph.Ref
+	if idx, err := buildstore.OpenIndex(buildStore, repo.CommitID); err == nil {
+		defer idx.Close()
+		refs, err = refsToDefIndexed(buildStore, repo, idx, key)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		refs, err = refsToDefScan(buildStore, repo, spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return groupRefsByFile(refs), nil
+}
+
+func refsToDefIndexed(buildStore *buildstore.RepositoryStore, repo *Repo, idx *buildstore.Index, key buildstore.DefKey) ([]*graph.Ref, error) {
+	locs, err := idx.DefRefs(key)
+	if err != nil {
+		return nil, err
+	}
+	if key.DefRepo == string(repo.URI()) {
+		// Refs to defs in the current repo usually leave DefRepo empty, and
+		// indexUnitRefs stores them under that empty DefRepo.
+		key.DefRepo = ""
+		more, err := idx.DefRefs(key)
+		if err != nil {
+			return nil, err
+		}
+		locs = append(locs, more...)
+	}
+
+	// Several locations usually share the same unit; decode each unit's
+	// graph output at most once.
+	type unitID struct{ name, typ string }
+	byUnit := make(map[unitID][]int) // unit ID -> ref indices
+	stubs := make(map[unitID]buildstore.UnitStub)
+	for _, loc := range locs {
+		id := unitID{loc.Unit.Name, loc.Unit.Type}
+		byUnit[id] = append(byUnit[id], loc.RefIdx)
+		stubs[id] = loc.Unit
+	}
+
+	var refs []*graph.Ref
+	for id, refIdxs := range byUnit {
+		stub := stubs[id]
+		g, err := decodeGraphOutput(buildStore, repo, &unit.SourceUnit{Name: stub.Name, Type: stub.Type})
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range refIdxs {
+			refs = append(refs, g.Refs[i])
+		}
+	}
+	return refs, nil
+}
+
+func refsToDefScan(buildStore *buildstore.RepositoryStore, repo *Repo, spec sourcegraph.DefSpec) ([]*graph.Ref, error) {
+	units, err := getAllSourceUnits(buildStore, repo)
+	if err != nil {
+		return nil, err
+	}
+	graphs, err := decodeGraphOutputs(buildStore, repo, units)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []*graph.Ref
+	for i, g := range graphs {
+		u := units[i]
+		for _, ref := range g.Refs {
+			defUnit, defUnitType := ref.DefUnit, ref.DefUnitType
+			if defUnit == "" {
+				defUnit = u.Name
+			}
+			if defUnitType == "" {
+				defUnitType = u.Type
+			}
+			defRepo := string(ref.DefRepo)
+			if defRepo == "" {
+				defRepo = string(repo.URI())
+			}
+			if defRepo == spec.Repo && defUnit == spec.Unit && defUnitType == spec.UnitType && string(ref.DefPath) == spec.Path {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs, nil
+}
+
+func groupRefsByFile(refs []*graph.Ref) []apiRefsFileGroup {
+	byFile := make(map[string][]*graph.Ref)
+	for _, ref := range refs {
+		byFile[ref.File] = append(byFile[ref.File], ref)
+	}
+
+	groups := make([]apiRefsFileGroup, 0, len(byFile))
+	for file, frefs := range byFile {
+		sort.Slice(frefs, func(i, j int) bool { return frefs[i].Start < frefs[j].Start })
+		groups = append(groups, apiRefsFileGroup{File: file, Refs: frefs})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].File < groups[j].File })
+	return groups
+}
+
+// mergeExternalRefs folds refs reported by Sourcegraph.com (in repos other
+// than the current one) into groups, keyed by their own File (which for
+// cross-repo refs is qualified by their source repo).
+func mergeExternalRefs(groups []apiRefsFileGroup, externalRefs []*sourcegraph.Ref) []apiRefsFileGroup {
+	if len(externalRefs) == 0 {
+		return groups
+	}
+	plain := make([]*graph.Ref, len(externalRefs))
+	for i := range externalRefs {
+		plain[i] = &externalRefs[i].Ref
+	}
+	return groupRefsByFile(append(flattenGroups(groups), plain...))
+}
+
+func flattenGroups(groups []apiRefsFileGroup) []*graph.Ref {
+	var refs []*graph.Ref
+	for _, g := range groups {
+		refs = append(refs, g.Refs...)
+	}
+	return refs
+}
+
+func (c *APIRefsCmd) writeOutput(groups []apiRefsFileGroup) error {
+	if c.Format == "jsonlines" {
+		w := bufio.NewWriter(os.Stdout)
+		enc := json.NewEncoder(w)
+		for _, g := range groups {
+			if err := enc.Encode(g); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}
+	return json.NewEncoder(os.Stdout).Encode(groups)
+}
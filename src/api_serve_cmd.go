@@ -0,0 +1,508 @@
+package src
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/howeyc/fsnotify"
+	"sourcegraph.com/sourcegraph/go-sourcegraph/sourcegraph"
+	"sourcegraph.com/sourcegraph/srclib/buildstore"
+	"sourcegraph.com/sourcegraph/srclib/config"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/grapher"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+type APIServeCmd struct {
+	Addr    string `long:"addr" description:"TCP address to additionally listen on for JSON-RPC 1.0 connections (e.g. :4389)" value-name:"ADDR"`
+	NoStdio bool   `long:"no-stdio" description:"don't serve JSON-RPC 1.0 over stdio"`
+}
+
+func (c *APIServeCmd) Execute(args []string) error {
+	repo, err := OpenRepo(".")
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chdir(repo.RootDir); err != nil {
+		return err
+	}
+
+	buildStore, err := buildstore.NewRepositoryStore(repo.RootDir)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureBuild(buildStore, repo); err != nil {
+		return err
+	}
+
+	srv, err := newAPIServer(buildStore, repo)
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+
+	rpcSrv := rpc.NewServer()
+	if err := rpcSrv.RegisterName("API", srv); err != nil {
+		return err
+	}
+	if err := rpcSrv.RegisterName("LSP", &lspAdapter{srv: srv}); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+
+	if !c.NoStdio {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rpcSrv.ServeCodec(jsonrpc.NewServerCodec(stdioConn{os.Stdin, os.Stdout}))
+		}()
+	}
+
+	if c.Addr != "" {
+		ln, err := net.Listen("tcp", c.Addr)
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		if GlobalOpt.Verbose {
+			log.Printf("api serve: listening for JSON-RPC 1.0 connections on %s", c.Addr)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					log.Println("api serve:", err)
+					return
+				}
+				go rpcSrv.ServeCodec(jsonrpc.NewServerCodec(conn))
+			}
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// stdioConn adapts stdin/stdout to the io.ReadWriteCloser that
+// jsonrpc.NewServerCodec expects.
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdioConn) Close() error { return nil }
+
+// apiServer holds a warm buildStore plus in-memory caches of decoded source
+// units and grapher outputs, so repeat describe/list/references/hover/
+// definition/documentSymbol calls don't re-walk the build store or
+// re-decode JSON on every request. It is invalidated incrementally as files
+// in the working tree change, rather than being thrown away wholesale.
+type apiServer struct {
+	buildStore *buildstore.RepositoryStore
+	repo       *Repo
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+
+	mu          sync.RWMutex
+	unitsByFile map[string][]*unit.SourceUnit // file -> source units containing it
+	graphs      map[string]*grapher.Output    // unit ID -> decoded graph output
+}
+
+func newAPIServer(buildStore *buildstore.RepositoryStore, repo *Repo) (*apiServer, error) {
+	s := &apiServer{
+		buildStore:  buildStore,
+		repo:        repo,
+		unitsByFile: make(map[string][]*unit.SourceUnit),
+		graphs:      make(map[string]*grapher.Output),
+		done:        make(chan struct{}),
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	s.watcher = w
+	if err := s.watchTree(repo.RootDir); err != nil {
+		w.Close()
+		return nil, err
+	}
+	go s.invalidateOnChange()
+
+	return s, nil
+}
+
+func (s *apiServer) watchTree(dir string) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == ".git" || fi.Name() == buildstore.BuildDataDirName {
+				return filepath.SkipDir
+			}
+			return s.watcher.Watch(path)
+		}
+		return nil
+	})
+}
+
+// invalidateOnChange rebuilds the unit(s) owning a changed file and evicts
+// their cache entries, instead of dropping the whole cache on every edit.
+func (s *apiServer) invalidateOnChange() {
+	for {
+		select {
+		case ev := <-s.watcher.Event:
+			if ev == nil {
+				return
+			}
+			rel, err := filepath.Rel(s.repo.RootDir, ev.Name)
+			if err != nil {
+				continue
+			}
+			file := filepath.Clean(rel)
+			s.rebuildFile(file)
+			s.invalidateFile(file)
+		case err := <-s.watcher.Error:
+			if err != nil && GlobalOpt.Verbose {
+				log.Printf("api serve: watcher error: %s", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// rebuildFile re-runs the toolchain for file's owning unit(s), via the same
+// filtered MakeCmd ensureBuild's incremental path uses, so the build
+// store's *.unit.json/graph.json for file are current by the time
+// invalidateFile's cache eviction causes them to be re-decoded. Without
+// this, invalidateFile only ever evicts the cache entries for the same
+// stale artifacts on disk, so a long-running `api serve` never reflects
+// edits made after startup.
+func (s *apiServer) rebuildFile(file string) {
+	makeCmd := &MakeCmd{
+		Options:          config.Options{Repo: string(s.repo.URI()), Subdir: "."},
+		ToolchainExecOpt: ToolchainExecOpt{ExeMethods: "program"},
+		OnlyFiles:        []string{file},
+	}
+	if err := makeCmd.Execute(nil); err != nil && GlobalOpt.Verbose {
+		log.Printf("api serve: couldn't rebuild %s: %s", file, err)
+	}
+}
+
+func (s *apiServer) invalidateFile(file string) {
+	// Graph outputs cached via References or findDef aren't recorded under
+	// unitsByFile[file], so also look up file's owning units in the store.
+	owners, err := getSourceUnitsWithFile(s.buildStore, s.repo, file)
+	if err != nil && GlobalOpt.Verbose {
+		log.Printf("api serve: couldn't look up units owning %s: %s", file, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.unitsByFile[file] {
+		delete(s.graphs, string(u.ID()))
+	}
+	for _, u := range owners {
+		delete(s.graphs, string(u.ID()))
+	}
+	delete(s.unitsByFile, file)
+
+	// allSourceUnits' cached full unit list (keyed by allUnitsCacheKey) may
+	// now be stale too — file could belong to a unit that didn't exist (or
+	// wasn't yet known) the last time it was scanned. Without this,
+	// References never picks up a new unit added after startup.
+	delete(s.unitsByFile, allUnitsCacheKey)
+}
+
+func (s *apiServer) Close() error {
+	close(s.done)
+	return s.watcher.Close()
+}
+
+func (s *apiServer) sourceUnitsWithFile(file string) ([]*unit.SourceUnit, error) {
+	s.mu.RLock()
+	units, cached := s.unitsByFile[file]
+	s.mu.RUnlock()
+	if cached {
+		return units, nil
+	}
+
+	units, err := lookupUnitsWithFile(s.buildStore, s.repo, file)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.unitsByFile[file] = units
+	s.mu.Unlock()
+	return units, nil
+}
+
+func (s *apiServer) graphOutput(u *unit.SourceUnit) (*grapher.Output, error) {
+	id := string(u.ID())
+
+	s.mu.RLock()
+	g, cached := s.graphs[id]
+	s.mu.RUnlock()
+	if cached {
+		return g, nil
+	}
+
+	g, err := decodeGraphOutput(s.buildStore, s.repo, u)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.graphs[id] = g
+	s.mu.Unlock()
+	return g, nil
+}
+
+// findRef is the cached equivalent of findRefAtPosition.
+func (s *apiServer) findRef(file string, startByte int) (*graph.Ref, error) {
+	units, err := s.sourceUnitsWithFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range units {
+		g, err := s.graphOutput(u)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range g.Refs {
+			if file == ref.File && startByte >= ref.Start && startByte <= ref.End {
+				if ref.DefUnit == "" {
+					ref.DefUnit = u.Name
+				}
+				if ref.DefUnitType == "" {
+					ref.DefUnitType = u.Type
+				}
+				return ref, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// findDef is the cached equivalent of findDefInRepo.
+func (s *apiServer) findDef(ref *graph.Ref) (*sourcegraph.Def, error) {
+	if ref.DefRepo == "" {
+		ref.DefRepo = s.repo.URI()
+	}
+	if ref.DefRepo != s.repo.URI() {
+		return nil, nil
+	}
+
+	g, err := s.graphOutput(&unit.SourceUnit{Name: ref.DefUnit, Type: ref.DefUnitType})
+	if err != nil {
+		return nil, err
+	}
+
+	var def *sourcegraph.Def
+	for _, def2 := range g.Defs {
+		if def2.Path == ref.DefPath {
+			def = &sourcegraph.Def{Def: *def2}
+			break
+		}
+	}
+	if def != nil {
+		for _, doc := range g.Docs {
+			if doc.Path == ref.DefPath {
+				def.DocHTML = doc.Data
+			}
+		}
+		def.File = filepath.Join(s.repo.RootDir, def.File)
+	}
+	return def, nil
+}
+
+// APIPositionArgs identifies a byte offset in a file, the unit of
+// reference shared by Describe, References, Hover, and Definition.
+type APIPositionArgs struct {
+	File      string
+	StartByte int
+}
+
+type APIListArgs struct {
+	File string
+}
+
+type APIDescribeReply struct {
+	Def      *sourcegraph.Def
+	Examples []*sourcegraph.Example
+}
+
+// Describe is the JSON-RPC counterpart of `src api describe`, served from
+// the warm cache instead of re-running the build. It resolves only defs in
+// the current repo: external defs are not fetched from Sourcegraph.com, and
+// reply.Examples is always left empty.
+func (s *apiServer) Describe(args *APIPositionArgs, reply *APIDescribeReply) error {
+	ref, err := s.findRef(args.File, args.StartByte)
+	if err != nil {
+		return err
+	}
+	if ref == nil {
+		return nil
+	}
+	def, err := s.findDef(ref)
+	if err != nil {
+		return err
+	}
+	reply.Def = def
+	return nil
+}
+
+// List is the JSON-RPC equivalent of `src api list`.
+func (s *apiServer) List(args *APIListArgs, reply *[]*graph.Ref) error {
+	units, err := s.sourceUnitsWithFile(args.File)
+	if err != nil {
+		return err
+	}
+	var refs []*graph.Ref
+	for _, u := range units {
+		g, err := s.graphOutput(u)
+		if err != nil {
+			return err
+		}
+		for _, ref := range g.Refs {
+			if args.File == ref.File {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	*reply = refs
+	return nil
+}
+
+// References enumerates every ref in the repo that resolves to the same
+// def as the ref under args.File/args.StartByte (a cheap, cache-backed
+// precursor to the standalone `src api refs` command).
+func (s *apiServer) References(args *APIPositionArgs, reply *[]*graph.Ref) error {
+	ref, err := s.findRef(args.File, args.StartByte)
+	if err != nil || ref == nil {
+		return err
+	}
+
+	units, err := s.allSourceUnits()
+	if err != nil {
+		return err
+	}
+
+	var refs []*graph.Ref
+	for _, u := range units {
+		g, err := s.graphOutput(u)
+		if err != nil {
+			return err
+		}
+		for _, ref2 := range g.Refs {
+			defUnit, defUnitType := ref2.DefUnit, ref2.DefUnitType
+			if defUnit == "" {
+				defUnit = u.Name
+			}
+			if defUnitType == "" {
+				defUnitType = u.Type
+			}
+			if ref2.DefRepo == ref.DefRepo && defUnit == ref.DefUnit &&
+				defUnitType == ref.DefUnitType && ref2.DefPath == ref.DefPath {
+				refs = append(refs, ref2)
+			}
+		}
+	}
+	*reply = refs
+	return nil
+}
+
+// allSourceUnits returns every source unit in the build store, caching the
+// result until the next file-change invalidation (see invalidateFile).
+func (s *apiServer) allSourceUnits() ([]*unit.SourceUnit, error) {
+	s.mu.RLock()
+	units, cached := s.unitsByFile[allUnitsCacheKey]
+	s.mu.RUnlock()
+	if cached {
+		return units, nil
+	}
+
+	units, err := getAllSourceUnits(s.buildStore, s.repo)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.unitsByFile[allUnitsCacheKey] = units
+	s.mu.Unlock()
+	return units, nil
+}
+
+// allUnitsCacheKey is not a valid cleaned file path, so it can't collide
+// with a real entry in unitsByFile.
+const allUnitsCacheKey = ""
+
+// Definition resolves the def for the ref under args.File/args.StartByte.
+func (s *apiServer) Definition(args *APIPositionArgs, reply *sourcegraph.Def) error {
+	ref, err := s.findRef(args.File, args.StartByte)
+	if err != nil || ref == nil {
+		return err
+	}
+	def, err := s.findDef(ref)
+	if err != nil || def == nil {
+		return err
+	}
+	*reply = *def
+	return nil
+}
+
+// Hover returns the doc/formatted-signature text for the def under
+// args.File/args.StartByte.
+func (s *apiServer) Hover(args *APIPositionArgs, reply *string) error {
+	var describeReply APIDescribeReply
+	if err := s.Describe(args, &describeReply); err != nil {
+		return err
+	}
+	if describeReply.Def == nil {
+		return nil
+	}
+	if describeReply.Def.DocHTML != "" {
+		*reply = describeReply.Def.DocHTML
+	} else {
+		*reply = fmt.Sprintf("%s %s", describeReply.Def.Kind, describeReply.Def.Name)
+	}
+	return nil
+}
+
+// DocumentSymbol returns the defs defined in args.File, drawn from the
+// source unit(s) containing it.
+func (s *apiServer) DocumentSymbol(args *APIListArgs, reply *[]*graph.Def) error {
+	units, err := s.sourceUnitsWithFile(args.File)
+	if err != nil {
+		return err
+	}
+	var defs []*graph.Def
+	for _, u := range units {
+		g, err := s.graphOutput(u)
+		if err != nil {
+			return err
+		}
+		for _, def := range g.Defs {
+			if def.File == args.File {
+				defs = append(defs, def)
+			}
+		}
+	}
+	*reply = defs
+	return nil
+}
@@ -0,0 +1,289 @@
+package src
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"sourcegraph.com/sourcegraph/srclib/buildstore"
+	"sourcegraph.com/sourcegraph/srclib/plan"
+	"sourcegraph.com/sourcegraph/srclib/toolchain"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// currentToolchainVersion fingerprints the toolchains currently installed
+// (by path and mtime), so that upgrading, reinstalling, or otherwise
+// changing a toolchain invalidates cached grapher output instead of
+// ensureBuild's incremental path silently reusing output produced by a
+// different version of it. Returns an error (rather than a static
+// placeholder) so a toolchain listing failure causes a safe fall back to a
+// full rebuild; see incrementalRebuildPlan.
+func currentToolchainVersion() (string, error) {
+	toolchains, err := toolchain.List()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha1.New()
+	for _, tc := range toolchains {
+		fi, err := os.Stat(tc.Path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s@%s\n", tc.Path, fi.ModTime())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildMeta is the small manifest ensureBuild's old "always re-make" TODO
+// was missing: a record of which commit was last built successfully, so
+// the next ensureBuild call can diff against it instead of doing a full
+// rebuild every time.
+type buildMeta struct {
+	CommitID         string
+	ToolchainVersion string
+}
+
+const buildMetaFilename = "build.meta.json"
+
+func readBuildMeta(buildStore *buildstore.RepositoryStore, commitID string) (*buildMeta, error) {
+	f, err := buildStore.Open(buildStore.FilePath(commitID, buildMetaFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m buildMeta
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func writeBuildMeta(buildStore *buildstore.RepositoryStore, commitID string, m *buildMeta) error {
+	w, err := buildStore.Create(buildStore.FilePath(commitID, buildMetaFilename))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	return json.NewEncoder(w).Encode(m)
+}
+
+// incrementalRebuildPlan decides which files, if any, ensureBuild should
+// restrict MakeCmd.OnlyFiles to. A non-empty reason means a full rebuild
+// is required and changedFiles/lastCommit should be ignored.
+func incrementalRebuildPlan(buildStore *buildstore.RepositoryStore, repo *Repo) (changedFiles []string, lastCommit string, reason string) {
+	gitRepo, err := git.PlainOpen(repo.RootDir)
+	if err != nil {
+		return nil, "", fmt.Sprintf("couldn't open %s as a git repository: %s", repo.RootDir, err)
+	}
+
+	wt, err := gitRepo.Worktree()
+	if err != nil {
+		return nil, "", fmt.Sprintf("couldn't open worktree: %s", err)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return nil, "", fmt.Sprintf("couldn't get worktree status: %s", err)
+	}
+	if !status.IsClean() {
+		return nil, "", "working tree is dirty"
+	}
+
+	last, err := findLastBuiltAncestor(buildStore, gitRepo, repo.CommitID)
+	if err != nil || last == "" {
+		return nil, "", "no previously built ancestor commit found"
+	}
+
+	meta, err := readBuildMeta(buildStore, last)
+	if err != nil {
+		return nil, "", fmt.Sprintf("couldn't read build manifest for %s: %s", last, err)
+	}
+	tcVersion, err := currentToolchainVersion()
+	if err != nil {
+		return nil, "", fmt.Sprintf("couldn't fingerprint installed toolchains: %s", err)
+	}
+	if meta.ToolchainVersion != tcVersion {
+		return nil, "", "toolchain version changed since last build"
+	}
+
+	changed, err := changedFilesBetween(gitRepo, last, repo.CommitID)
+	if err != nil {
+		return nil, "", fmt.Sprintf("couldn't diff %s..%s: %s", last, repo.CommitID, err)
+	}
+	return changed, last, ""
+}
+
+// findLastBuiltAncestor walks the commit log backwards from commitID,
+// returning the nearest ancestor (other than commitID itself) for which a
+// build manifest exists, i.e. that was built successfully before.
+func findLastBuiltAncestor(buildStore *buildstore.RepositoryStore, gitRepo *git.Repository, commitID string) (string, error) {
+	start, err := gitRepo.CommitObject(plumbing.NewHash(commitID))
+	if err != nil {
+		return "", err
+	}
+
+	iter, err := gitRepo.Log(&git.LogOptions{From: start.Hash})
+	if err != nil {
+		return "", err
+	}
+	defer iter.Close()
+
+	var found string
+	err = iter.ForEach(func(c *object.Commit) error {
+		if c.Hash == start.Hash {
+			return nil
+		}
+		if _, err := buildStore.Stat(buildStore.FilePath(c.Hash.String(), buildMetaFilename)); err == nil {
+			found = c.Hash.String()
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return found, nil
+}
+
+// changedFilesBetween returns the repo-relative paths that differ between
+// the from and to commits' trees.
+func changedFilesBetween(gitRepo *git.Repository, from, to string) ([]string, error) {
+	fromTree, err := commitTree(gitRepo, from)
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := commitTree(gitRepo, to)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := fromTree.Diff(toTree)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(changes))
+	for _, c := range changes {
+		if c.To.Name != "" {
+			files = append(files, c.To.Name)
+		} else {
+			files = append(files, c.From.Name)
+		}
+	}
+	return files, nil
+}
+
+func commitTree(gitRepo *git.Repository, commitID string) (*object.Tree, error) {
+	commit, err := gitRepo.CommitObject(plumbing.NewHash(commitID))
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+// seedUnchangedUnits hard-links (falling back to copying) every build
+// artifact under lastCommit's build directory into repo.CommitID's build
+// directory that the just-completed filtered MakeCmd run didn't already
+// produce, so the new commit's build directory ends up complete even
+// though only changed units were re-graphed.
+func seedUnchangedUnits(buildStore *buildstore.RepositoryStore, repo *Repo, lastCommit string) error {
+	fromDir := buildStore.CommitPath(lastCommit)
+	toDir := buildStore.CommitPath(repo.CommitID)
+
+	stale, err := staleUnitArtifacts(repo, fromDir)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(fromDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(fromDir, path)
+		if err != nil {
+			return err
+		}
+		if stale[rel] {
+			return nil // unit (or one of the files it claims) no longer exists at repo.CommitID
+		}
+		dst := filepath.Join(toDir, rel)
+		if _, err := os.Stat(dst); err == nil {
+			return nil // the filtered MakeCmd run already (re)wrote this one
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		if err := os.Link(path, dst); err == nil {
+			return nil
+		}
+		return copyFile(path, dst)
+	})
+}
+
+// staleUnitArtifacts returns the fromDir-relative paths of unit artifacts
+// (a unit's *.unit.json plus its *.graph.json counterpart) that
+// seedUnchangedUnits must not carry forward, because the unit claims a
+// file that no longer exists in repo's working tree. Without this check, a
+// unit or file deleted since lastCommit would keep reporting defs/refs for
+// code that's gone.
+func staleUnitArtifacts(repo *Repo, fromDir string) (map[string]bool, error) {
+	unitSuffix := buildstore.DataTypeSuffix(unit.SourceUnit{})
+	stale := make(map[string]bool)
+
+	err := filepath.Walk(fromDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(path, unitSuffix) {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		var u unit.SourceUnit
+		err = json.NewDecoder(f).Decode(&u)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		deleted := false
+		for _, uf := range u.Files {
+			if _, err := os.Stat(filepath.Join(repo.RootDir, uf)); os.IsNotExist(err) {
+				deleted = true
+				break
+			}
+		}
+		if !deleted {
+			return nil
+		}
+
+		stale[plan.SourceUnitDataFilename("unit", &u)] = true
+		stale[plan.SourceUnitDataFilename("graph", &u)] = true
+		return nil
+	})
+	return stale, err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
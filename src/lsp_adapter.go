@@ -0,0 +1,264 @@
+package src
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/go-sourcegraph/sourcegraph"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// lspAdapter translates Language Server Protocol method calls
+// (textDocument/hover, textDocument/definition, textDocument/references,
+// textDocument/documentSymbol) into calls against the cached apiServer, so
+// any LSP-capable editor can drive `src api serve` without knowing
+// anything about srclib's own JSON-RPC methods.
+//
+// It is registered alongside apiServer under the "LSP" net/rpc service
+// name, on the same JSON-RPC 1.0 server. LSP's own JSON-RPC 2.0 messages
+// are not accepted as is: a proxy in front of the editor has to map each
+// LSP method to its LSP.<Name> counterpart (textDocument/hover to
+// LSP.Hover, and so on) and send the LSP params object as the single
+// element of a JSON-RPC 1.0 params array.
+type lspAdapter struct {
+	srv *apiServer
+}
+
+// lspTextDocumentIdentifier identifies a file the way LSP does: by file://
+// URI. srclib addresses files as repo-relative paths, so uriToFile strips
+// the scheme and makes the result relative to the repo root.
+type lspTextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+// lspPosition is a zero-based line/character pair, as used throughout LSP.
+// srclib addresses positions as byte offsets, so converting between the
+// two requires reading the file (see (*lspAdapter).offset and
+// (*lspAdapter).position, its inverse).
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspTextDocumentPositionParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+	Position     lspPosition               `json:"position"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspSymbolInformation struct {
+	Name     string      `json:"name"`
+	Kind     int         `json:"kind"`
+	Location lspLocation `json:"location"`
+}
+
+type lspHover struct {
+	Contents []string `json:"contents"`
+}
+
+func (a *lspAdapter) uriToFile(uri string) string {
+	path := strings.TrimPrefix(uri, "file://")
+	if rel, err := filepath.Rel(a.srv.repo.RootDir, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+func (a *lspAdapter) fileToURI(file string) string {
+	return "file://" + filepath.Join(a.srv.repo.RootDir, file)
+}
+
+// offset converts an LSP line/character position to the byte offset that
+// srclib ref/def lookups key on.
+func (a *lspAdapter) offset(file string, pos lspPosition) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(a.srv.repo.RootDir, file))
+	if err != nil {
+		return 0, err
+	}
+
+	line, col := 0, 0
+	for i, b := range data {
+		if line == pos.Line && col == pos.Character {
+			return i, nil
+		}
+		if b == '\n' {
+			line++
+			col = 0
+		} else {
+			col++
+		}
+	}
+	if line == pos.Line && col == pos.Character {
+		return len(data), nil
+	}
+	return 0, fmt.Errorf("position %d:%d is out of range in %s", pos.Line, pos.Character, file)
+}
+
+// position converts a srclib byte offset in file to the LSP line/character
+// position it falls at — the inverse of offset.
+func (a *lspAdapter) position(file string, byteOffset int) (lspPosition, error) {
+	data, err := ioutil.ReadFile(filepath.Join(a.srv.repo.RootDir, file))
+	if err != nil {
+		return lspPosition{}, err
+	}
+	if byteOffset > len(data) {
+		byteOffset = len(data)
+	}
+
+	line, col := 0, 0
+	for i := 0; i < byteOffset; i++ {
+		if data[i] == '\n' {
+			line++
+			col = 0
+		} else {
+			col++
+		}
+	}
+	return lspPosition{Line: line, Character: col}, nil
+}
+
+// lspRange converts a [start, end) srclib byte range in file to an LSP
+// Range of line/character positions.
+func (a *lspAdapter) lspRange(file string, start, end int) (lspRange, error) {
+	startPos, err := a.position(file, start)
+	if err != nil {
+		return lspRange{}, err
+	}
+	endPos, err := a.position(file, end)
+	if err != nil {
+		return lspRange{}, err
+	}
+	return lspRange{Start: startPos, End: endPos}, nil
+}
+
+func (a *lspAdapter) positionArgs(p lspTextDocumentPositionParams) (*APIPositionArgs, error) {
+	file := filepath.Clean(a.uriToFile(p.TextDocument.URI))
+	byteOffset, err := a.offset(file, p.Position)
+	if err != nil {
+		return nil, err
+	}
+	return &APIPositionArgs{File: file, StartByte: byteOffset}, nil
+}
+
+// Hover implements textDocument/hover.
+func (a *lspAdapter) Hover(params lspTextDocumentPositionParams, reply *lspHover) error {
+	args, err := a.positionArgs(params)
+	if err != nil {
+		return err
+	}
+	var hover string
+	if err := a.srv.Hover(args, &hover); err != nil {
+		return err
+	}
+	if hover != "" {
+		reply.Contents = []string{hover}
+	}
+	return nil
+}
+
+// Definition implements textDocument/definition.
+func (a *lspAdapter) Definition(params lspTextDocumentPositionParams, reply *[]lspLocation) error {
+	args, err := a.positionArgs(params)
+	if err != nil {
+		return err
+	}
+	var def sourcegraph.Def
+	if err := a.srv.Definition(args, &def); err != nil || def.Path == "" {
+		return err
+	}
+	// findDef makes def.File absolute; lspRange and fileToURI take
+	// repo-relative paths.
+	file, err := filepath.Rel(a.srv.repo.RootDir, def.File)
+	if err != nil {
+		return err
+	}
+	r, err := a.lspRange(file, def.DefStart, def.DefEnd)
+	if err != nil {
+		return err
+	}
+	*reply = []lspLocation{{URI: a.fileToURI(file), Range: r}}
+	return nil
+}
+
+// References implements textDocument/references.
+func (a *lspAdapter) References(params lspTextDocumentPositionParams, reply *[]lspLocation) error {
+	args, err := a.positionArgs(params)
+	if err != nil {
+		return err
+	}
+	var refs []*graph.Ref
+	if err := a.srv.References(args, &refs); err != nil {
+		return err
+	}
+	locs := make([]lspLocation, len(refs))
+	for i, ref := range refs {
+		r, err := a.lspRange(ref.File, ref.Start, ref.End)
+		if err != nil {
+			return err
+		}
+		locs[i] = lspLocation{URI: a.fileToURI(ref.File), Range: r}
+	}
+	*reply = locs
+	return nil
+}
+
+type lspDocumentSymbolParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+}
+
+// DocumentSymbol implements textDocument/documentSymbol.
+func (a *lspAdapter) DocumentSymbol(params lspDocumentSymbolParams, reply *[]lspSymbolInformation) error {
+	file := filepath.Clean(a.uriToFile(params.TextDocument.URI))
+	var defs []*graph.Def
+	if err := a.srv.DocumentSymbol(&APIListArgs{File: file}, &defs); err != nil {
+		return err
+	}
+	syms := make([]lspSymbolInformation, len(defs))
+	for i, def := range defs {
+		r, err := a.lspRange(def.File, def.DefStart, def.DefEnd)
+		if err != nil {
+			return err
+		}
+		syms[i] = lspSymbolInformation{
+			Name:     def.Name,
+			Kind:     lspSymbolKind(def.Kind),
+			Location: lspLocation{URI: a.fileToURI(def.File), Range: r},
+		}
+	}
+	*reply = syms
+	return nil
+}
+
+// lspSymbolKind maps a srclib def kind string to the closest LSP
+// SymbolKind constant, defaulting to Variable (13) when there's no good
+// match. This is necessarily lossy: srclib's kinds are toolchain-defined
+// free text, while LSP's are a fixed enum.
+func lspSymbolKind(kind string) int {
+	switch strings.ToLower(kind) {
+	case "func", "function", "method":
+		return 12
+	case "type", "class", "struct":
+		return 5
+	case "interface":
+		return 11
+	case "package", "module":
+		return 4
+	case "field":
+		return 8
+	case "const", "constant":
+		return 14
+	default:
+		return 13
+	}
+}
@@ -0,0 +1,86 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+
+	"code.google.com/p/rog-go/parallel"
+	"sourcegraph.com/sourcegraph/srclib/buildstore"
+	"sourcegraph.com/sourcegraph/srclib/grapher"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// apiParallelism bounds how many buildStore.Open + json.Decode calls the
+// API commands run concurrently when decoding many unit/graph files. It
+// defaults to runtime.NumCPU() and can be overridden per invocation via
+// each command's --api-parallelism flag (see setAPIParallelism).
+var apiParallelism = runtime.NumCPU()
+
+// setAPIParallelism applies an --api-parallelism flag value, treating n <=
+// 0 (the flag's zero value when unset) as "keep the default".
+func setAPIParallelism(n int) {
+	if n > 0 {
+		apiParallelism = n
+	}
+}
+
+// decodeUnitFiles decodes each of unitFiles (paths to *.unit.json within
+// buildStore) across a bounded pool of apiParallelism workers. Results are
+// written to their own slice index, so the returned slice is in the same
+// order as unitFiles regardless of which worker finishes first, and run
+// aborts the remaining work as soon as any decode fails.
+func decodeUnitFiles(buildStore *buildstore.RepositoryStore, unitFiles []string) ([]*unit.SourceUnit, error) {
+	units := make([]*unit.SourceUnit, len(unitFiles))
+	run := parallel.NewRun(apiParallelism)
+	var failed int32
+	for i_, unitFile_ := range unitFiles {
+		i, unitFile := i_, unitFile_
+		run.Do(func() error {
+			if atomic.LoadInt32(&failed) != 0 {
+				return nil
+			}
+			f, err := buildStore.Open(unitFile)
+			if err != nil {
+				atomic.StoreInt32(&failed, 1)
+				return err
+			}
+			defer f.Close()
+			var u *unit.SourceUnit
+			if err := json.NewDecoder(f).Decode(&u); err != nil {
+				atomic.StoreInt32(&failed, 1)
+				return fmt.Errorf("%s: %s", unitFile, err)
+			}
+			units[i] = u
+			return nil
+		})
+	}
+	if err := run.Wait(); err != nil {
+		return nil, err
+	}
+	return units, nil
+}
+
+// decodeGraphOutputs decodes the graph.json for each of units across a
+// bounded pool of apiParallelism workers, returning outputs in the same
+// order as units.
+func decodeGraphOutputs(buildStore *buildstore.RepositoryStore, repo *Repo, units []*unit.SourceUnit) ([]*grapher.Output, error) {
+	outputs := make([]*grapher.Output, len(units))
+	run := parallel.NewRun(apiParallelism)
+	for i_, u_ := range units {
+		i, u := i_, u_
+		run.Do(func() error {
+			g, err := decodeGraphOutput(buildStore, repo, u)
+			if err != nil {
+				return err
+			}
+			outputs[i] = g
+			return nil
+		})
+	}
+	if err := run.Wait(); err != nil {
+		return nil, err
+	}
+	return outputs, nil
+}
@@ -0,0 +1,103 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/buildstore"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/grapher"
+	"sourcegraph.com/sourcegraph/srclib/plan"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// writeTestFile JSON-encodes v to path within buildStore, creating parent
+// directories as needed.
+func writeTestFile(t *testing.T, buildStore *buildstore.RepositoryStore, path string, v interface{}) {
+	t.Helper()
+	w, err := buildStore.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDecodeUnitFiles_Order checks that decodeUnitFiles returns units in
+// the same order as the unitFiles passed in, regardless of which worker in
+// the pool happens to finish decoding first.
+func TestDecodeUnitFiles_Order(t *testing.T) {
+	defer func(n int) { apiParallelism = n }(apiParallelism)
+	apiParallelism = 4
+
+	buildStore, err := buildstore.NewRepositoryStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const commitID = "abc123"
+
+	const n = 20
+	var unitFiles []string
+	var wantNames []string
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("unit%d", i)
+		path := buildStore.FilePath(commitID, fmt.Sprintf("%s.unit.json", name))
+		writeTestFile(t, buildStore, path, &unit.SourceUnit{Name: name, Type: "test"})
+		unitFiles = append(unitFiles, path)
+		wantNames = append(wantNames, name)
+	}
+
+	units, err := decodeUnitFiles(buildStore, unitFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotNames []string
+	for _, u := range units {
+		gotNames = append(gotNames, u.Name)
+	}
+	if !reflect.DeepEqual(gotNames, wantNames) {
+		t.Errorf("decodeUnitFiles returned units in order %v, want %v", gotNames, wantNames)
+	}
+}
+
+// TestDecodeGraphOutputs_Order checks that decodeGraphOutputs returns
+// outputs in the same order as the units passed in, regardless of
+// scheduling.
+func TestDecodeGraphOutputs_Order(t *testing.T) {
+	defer func(n int) { apiParallelism = n }(apiParallelism)
+	apiParallelism = 4
+
+	buildStore, err := buildstore.NewRepositoryStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &Repo{RootDir: t.TempDir(), CommitID: "abc123"}
+
+	const n = 20
+	var units []*unit.SourceUnit
+	var wantFiles []string
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("unit%d", i)
+		u := &unit.SourceUnit{Name: name, Type: "test"}
+		units = append(units, u)
+		wantFiles = append(wantFiles, name)
+		path := buildStore.FilePath(repo.CommitID, plan.SourceUnitDataFilename("graph", u))
+		writeTestFile(t, buildStore, path, &grapher.Output{Refs: []*graph.Ref{{File: name}}})
+	}
+
+	outputs, err := decodeGraphOutputs(buildStore, repo, units)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotFiles []string
+	for _, g := range outputs {
+		gotFiles = append(gotFiles, g.Refs[0].File)
+	}
+	if !reflect.DeepEqual(gotFiles, wantFiles) {
+		t.Errorf("decodeGraphOutputs returned outputs in order %v, want %v", gotFiles, wantFiles)
+	}
+}